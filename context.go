@@ -0,0 +1,124 @@
+// Copyright (c) 2024
+// Author: Jeff Weisberg <jaw @ tcp4me.com>
+// Created: 2024-Nov-04 14:27 (EST)
+// Function: context.Context-aware logging
+
+package diag
+
+import (
+	"context"
+	"sync"
+)
+
+type ctxKey struct{}
+
+// ContextExtractor pulls structured fields (eg request id, trace id,
+// user id) out of a context.Context, for every *Ctx logging call.
+type ContextExtractor func(ctx context.Context) map[string]interface{}
+
+var ctxExtractorLock sync.Mutex
+var ctxExtractor ContextExtractor
+
+// RegisterContextExtractor installs the function used by every *Ctx
+// logging call to pull structured fields out of a context.Context, eg
+// a request id or trace/span id set up by middleware.
+func RegisterContextExtractor(f ContextExtractor) {
+	ctxExtractorLock.Lock()
+	defer ctxExtractorLock.Unlock()
+	ctxExtractor = f
+}
+
+// NewContext returns a child context carrying the given key/value pairs
+// (key, val, key, val, ...), to be picked up by FromContext and by every
+// *Ctx logging call for the lifetime of that context.
+func NewContext(ctx context.Context, kv ...interface{}) context.Context {
+	fields := make(map[string]interface{})
+	for k, v := range fieldsFromContext(ctx) {
+		fields[k] = v
+	}
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			continue
+		}
+		fields[key] = kv[i+1]
+	}
+
+	return context.WithValue(ctx, ctxKey{}, fields)
+}
+
+// FromContext returns the fields attached to ctx by NewContext, or nil.
+func FromContext(ctx context.Context) map[string]interface{} {
+	return fieldsFromContext(ctx)
+}
+
+func fieldsFromContext(ctx context.Context) map[string]interface{} {
+	fields, _ := ctx.Value(ctxKey{}).(map[string]interface{})
+	return fields
+}
+
+// withCtx returns a Diag that logs with the fields carried by ctx (both
+// the registered ContextExtractor's and any attached via NewContext)
+// added on top of d's own fields.
+func (d *Diag) withCtx(ctx context.Context) *Diag {
+	n := *d
+	n.uplevel++ // one more frame between the caller and diag() than d's plain methods
+
+	ctxExtractorLock.Lock()
+	ext := ctxExtractor
+	ctxExtractorLock.Unlock()
+
+	n.fields = make(map[string]interface{}, len(d.fields))
+	for k, v := range d.fields {
+		n.fields[k] = v
+	}
+	if ext != nil {
+		for k, v := range ext(ctx) {
+			n.fields[k] = v
+		}
+	}
+	for k, v := range fieldsFromContext(ctx) {
+		n.fields[k] = v
+	}
+
+	return &n
+}
+
+// TraceCtx is Trace, with fields pulled from ctx attached to the message
+func (d *Diag) TraceCtx(ctx context.Context, format string, args ...interface{}) {
+	d.withCtx(ctx).Trace(format, args...)
+}
+
+// DebugCtx is Debug, with fields pulled from ctx attached to the message
+func (d *Diag) DebugCtx(ctx context.Context, format string, args ...interface{}) {
+	d.withCtx(ctx).Debug(format, args...)
+}
+
+// VerboseCtx is Verbose, with fields pulled from ctx attached to the message
+func (d *Diag) VerboseCtx(ctx context.Context, format string, args ...interface{}) {
+	d.withCtx(ctx).Verbose(format, args...)
+}
+
+// InfoCtx is Info, with fields pulled from ctx attached to the message
+func (d *Diag) InfoCtx(ctx context.Context, format string, args ...interface{}) {
+	d.withCtx(ctx).Info(format, args...)
+}
+
+// ProblemCtx is Problem, with fields pulled from ctx attached to the
+// message, in both the stderr line and the notification email
+func (d *Diag) ProblemCtx(ctx context.Context, format string, args ...interface{}) {
+	d.withCtx(ctx).Problem(format, args...)
+}
+
+// BugCtx is Bug, with fields pulled from ctx attached to the message, in
+// both the stderr line and the notification email
+func (d *Diag) BugCtx(ctx context.Context, format string, args ...interface{}) {
+	d.withCtx(ctx).Bug(format, args...)
+}
+
+// FatalCtx is Fatal, with fields pulled from ctx attached to the
+// message, in both the stderr line and the notification email
+func (d *Diag) FatalCtx(ctx context.Context, format string, args ...interface{}) {
+	d.withCtx(ctx).Fatal(format, args...)
+}
@@ -20,14 +20,12 @@ in code:
 package diag
 
 import (
-	"context"
 	"flag"
 	"fmt"
-	"log/syslog"
 	"os"
-	"os/exec"
 	"path"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -35,8 +33,7 @@ import (
 
 // defaults
 const (
-	stackMax  = 1048576
-	rateLimit = time.Minute
+	stackMax = 1048576
 )
 
 var hostname = "?"
@@ -44,9 +41,7 @@ var progname = "?"
 
 var lock sync.RWMutex
 var config = &Config{}
-var mailSent = make(map[string]time.Time)
 var defaultDiag = &Diag{section: "default", useStderr: true, uplevel: 3}
-var slog *syslog.Writer
 
 type Diag struct {
 	section   string
@@ -56,25 +51,60 @@ type Diag struct {
 	progname  string
 	debugAll  bool
 	useStderr bool
+	fields    map[string]interface{}
+	mailer    Mailer
 }
 
 // Config configures the loggger
 type Config struct {
-	MailTo        string
-	MailFrom      string
+	MailTo   string
+	MailFrom string
+	// MailRateLimit is the refill period of the per-(section,address)
+	// token bucket: one token every MailRateLimit, up to MailBurst.
+	// Zero means one token per minute.
 	MailRateLimit time.Duration
-	Sendmail      string
-	Facility      string
+	// MailBurst is the token bucket capacity; zero means 1 (the old
+	// "at most one mail per MailRateLimit" behavior).
+	MailBurst int
+	// DigestInterval is how often suppressed messages (ie those that hit
+	// the token bucket empty) are summarized into one digest email.
+	// Zero means 15 minutes.
+	DigestInterval time.Duration
+	Sendmail       string
+	Facility       string
+	// SyslogNetwork/SyslogAddr point the syslog sink at a remote host, eg
+	// ("udp", "logs.example.com:514"). Left empty, it dials the local
+	// syslog daemon.
+	SyslogNetwork string
+	SyslogAddr    string
 	ProgName      string
 	Debug         map[string]bool
+	// Mailer overrides how Problem/Bug/Fatal mail is delivered. Defaults
+	// to NewSMTPMailer(SMTP) if SMTP.Host is set, else a SendmailMailer.
+	Mailer Mailer
+	SMTP   SMTPConfig
+	// Sinks are additional destinations every log entry is fanned out to,
+	// alongside the built-in stderr/syslog/email paths.
+	Sinks []Sink
+	// LogLevel is the default verbosity threshold; messages below it are
+	// suppressed unless LevelOverrides says otherwise. Zero means
+	// LevelVerbose.
+	LogLevel Level
+	// LevelOverrides raises or lowers the threshold per section, eg
+	// {"net": LevelDebug, "auth": LevelTrace}. The key "all" sets the
+	// default for any section without its own entry.
+	LevelOverrides map[string]Level
 }
 
 type logconf struct {
-	logprio   syslog.Priority
+	level     Level
 	toStderr  bool
 	toEmail   bool
 	withInfo  bool
 	withTrace bool
+	// mailSync sends email synchronously instead of queuing it, for
+	// Fatal, which can't risk the process exiting before it's delivered.
+	mailSync bool
 }
 
 func init() {
@@ -101,44 +131,93 @@ func (d *Diag) WithMailFrom(e string) *Diag {
 	return &n
 }
 
+// WithMailer overrides the Mailer used to deliver Problem/Bug/Fatal mail
+func (d *Diag) WithMailer(m Mailer) *Diag {
+	var n Diag
+	n = *d
+	n.mailer = m
+	return &n
+}
+
+// With returns a child logger that attaches the given key/value pair to
+// every message it logs, in every configured Sink.
+func (d *Diag) With(key string, val interface{}) *Diag {
+	var n Diag
+	n = *d
+
+	n.fields = make(map[string]interface{}, len(d.fields)+1)
+	for k, v := range d.fields {
+		n.fields[k] = v
+	}
+	n.fields[key] = val
+
+	return &n
+}
+
+// Trace logs a message at trace priority - the most verbose level
+func (d *Diag) Trace(format string, args ...interface{}) {
+	if !d.enabled(LevelTrace) {
+		return
+	}
+	diag(logconf{
+		level:    LevelTrace,
+		toStderr: true,
+		withInfo: true,
+	}, d, format, args)
+}
+
 // Verbose logs a message at verbose priority
 func (d *Diag) Verbose(format string, args ...interface{}) {
+	if !d.enabled(LevelVerbose) {
+		return
+	}
 	diag(logconf{
-		logprio:  syslog.LOG_INFO,
+		level:    LevelVerbose,
 		toStderr: true,
 	}, d, format, args)
 }
 
 // Debug logs a message at debug priority
 func (d *Diag) Debug(format string, args ...interface{}) {
-
-	var cf = getConfig()
-
-	if !d.debugAll && !cf.Debug[d.section] && !cf.Debug["all"] {
+	if !d.enabled(LevelDebug) {
 		return
 	}
-
 	diag(logconf{
-		logprio:  syslog.LOG_DEBUG,
+		level:    LevelDebug,
 		toStderr: true,
 		withInfo: true,
 	}, d, format, args)
 }
 
-// Problem logs a message indicating a problem
+// Info logs a message at info priority
+func (d *Diag) Info(format string, args ...interface{}) {
+	if !d.enabled(LevelInfo) {
+		return
+	}
+	diag(logconf{
+		level:    LevelInfo,
+		toStderr: true,
+	}, d, format, args)
+}
+
+// Problem logs a message indicating a problem. Unlike Trace/Debug/
+// Verbose/Info, it is not gated by Config.LogLevel/LevelOverrides - a
+// verbosity knob turned down to quiet routine logging must not also be
+// able to silently turn off incident notifications.
 func (d *Diag) Problem(format string, args ...interface{}) {
 	diag(logconf{
-		logprio:  syslog.LOG_WARNING,
+		level:    LevelWarn,
 		toStderr: true,
 		toEmail:  true,
 		withInfo: true,
 	}, d, format, args)
 }
 
-// Bug logs a message indicating a bug
+// Bug logs a message indicating a bug. Like Problem, it ignores the
+// level threshold so it can't be silenced by a verbosity knob.
 func (d *Diag) Bug(format string, args ...interface{}) {
 	diag(logconf{
-		logprio:   syslog.LOG_ERR,
+		level:     LevelError,
 		toStderr:  true,
 		toEmail:   true,
 		withInfo:  true,
@@ -146,14 +225,17 @@ func (d *Diag) Bug(format string, args ...interface{}) {
 	}, d, format, args)
 }
 
-// Fatal logs a message at high priority + terminates the program
+// Fatal logs a message at high priority + terminates the program. Like
+// Problem/Bug, it ignores the level threshold so it can't be silenced
+// by a verbosity knob.
 func (d *Diag) Fatal(format string, args ...interface{}) {
 	diag(logconf{
-		logprio:   syslog.LOG_ERR,
+		level:     LevelFatal,
 		toStderr:  true,
 		toEmail:   true,
 		withInfo:  true,
 		withTrace: true,
+		mailSync:  true,
 	}, d, format, args)
 
 	os.Exit(-1)
@@ -209,11 +291,25 @@ func (d *Diag) SetStderr(x bool) {
 func SetConfig(cf Config) {
 	lock.Lock()
 	defer lock.Unlock()
-	config = &cf
 
-	if slog == nil {
-		openSyslog(cf.Facility)
+	// flag/env overrides (-loglevels, DIAG_LOG_LEVELS) live in
+	// flagLevelOverrides, separate from Config.LevelOverrides, so that
+	// this wholesale `config = &cf` can't discard them; they win over
+	// whatever the application passes in.
+	if len(flagLevelOverrides) > 0 {
+		merged := make(map[string]Level, len(cf.LevelOverrides)+len(flagLevelOverrides))
+		for k, v := range cf.LevelOverrides {
+			merged[k] = v
+		}
+		for k, v := range flagLevelOverrides {
+			merged[k] = v
+		}
+		cf.LevelOverrides = merged
 	}
+
+	config = &cf
+
+	configureSyslog(cf)
 }
 
 func getConfig() *Config {
@@ -234,51 +330,68 @@ func SetDebugFlag(f string, v bool) {
 
 func diag(cf logconf, d *Diag, format string, args []interface{}) {
 
-	var out string
+	var prefix string
+	var fileshort = "?"
+	var funName = "?"
+	var line int
 
-	if cf.withInfo {
-		pc, file, line, ok := runtime.Caller(d.uplevel)
-		if ok {
-			// file is full pathname - trim
-			fileshort := cleanFilename(file)
-
-			// get function name
-			fun := runtime.FuncForPC(pc)
-			if fun != nil {
-				funName := cleanFunName(fun.Name())
-				out = fmt.Sprintf("%s:%d %s(): ", fileshort, line, funName)
-			} else {
-				out = fmt.Sprintf("%s:%d ?(): ", fileshort, line)
-			}
-		} else {
-			out = "?:?: "
+	pc, file, ln, ok := runtime.Caller(d.uplevel)
+	if ok {
+		// file is full pathname - trim
+		fileshort = cleanFilename(file)
+		line = ln
+
+		// get function name
+		if fun := runtime.FuncForPC(pc); fun != nil {
+			funName = cleanFunName(fun.Name())
 		}
 	}
 
+	if cf.withInfo {
+		prefix = fmt.Sprintf("%s:%d %s(): ", fileshort, line, funName)
+	}
+
 	// remove a trailing newline
 	if format[len(format)-1] == '\n' {
 		format = format[:len(format)-1]
 	}
 
-	out = out + fmt.Sprintf(format, args...)
+	msg := fmt.Sprintf(format, args...)
+	if len(d.fields) > 0 {
+		msg += formatFields(d.fields)
+	}
+	out := prefix + msg
 
 	if cf.toStderr && d.useStderr {
 		fmt.Fprintln(os.Stderr, out)
 	}
 
-	// syslog
-	if slog != nil {
-		sendToSyslog(cf.logprio, out)
-	}
-
 	// email
 	if cf.toEmail {
-		sendEmail(d, out, cf.withTrace)
+		sendEmail(d, fileshort, line, out, cf.withTrace, cf.mailSync)
 	}
 
+	// fan out to any configured sinks
+	if snks := activeSinks(); len(snks) > 0 {
+		e := Entry{
+			Section: d.section,
+			Level:   cf.level,
+			Time:    time.Now(),
+			File:    fileshort,
+			Line:    line,
+			Func:    funName,
+			Text:    msg,
+			Fields:  d.fields,
+		}
+		for _, s := range snks {
+			if err := s.WriteMsg(e); err != nil {
+				reportSinkErr(s, err)
+			}
+		}
+	}
 }
 
-func sendEmail(d *Diag, txt string, withTrace bool) {
+func sendEmail(d *Diag, file string, line int, txt string, withTrace, syncSend bool) {
 
 	cf := getConfig()
 
@@ -306,101 +419,38 @@ func sendEmail(d *Diag, txt string, withTrace bool) {
 		return
 	}
 
-	if cf.rateLimited(dcf.mailTo) {
+	if !cf.allowMail(d.section, dcf.mailTo) {
+		recordSuppressed(d.section, dcf.mailTo, fmt.Sprintf("%s:%d", file, line), txt)
 		return
 	}
 
-	sendmail := "sendmail"
-	if cf.Sendmail != "" {
-		sendmail = cf.Sendmail
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, sendmail, "-t", "-f", dcf.mailFrom)
-
-	p, _ := cmd.StdinPipe()
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	cmd.Start()
+	var body strings.Builder
+	fmt.Fprintf(&body, "an error was detected in %s\n\nhost:   %s\npid:    %d\n\n",
+		dcf.progname, hostname, os.Getpid())
+	fmt.Fprintf(&body, "error:\n%s\n", txt)
 
-	go func() {
-		fmt.Fprintf(p, "To: %s\nFrom: %s\nSubject: %s daemon error\n\n",
-			dcf.mailTo, dcf.mailFrom, dcf.progname)
-
-		fmt.Fprintf(p, "an error was detected in %s\n\nhost:   %s\npid:    %d\n\n",
-			dcf.progname, hostname, os.Getpid())
-
-		fmt.Fprintf(p, "error:\n%s\n", txt)
-
-		if withTrace {
-			var stack = make([]byte, stackMax)
-			stack = stack[:runtime.Stack(stack, true)]
-			fmt.Fprintf(p, "\n\n%s\n", stack)
-		}
-
-		p.Close()
-	}()
-
-	cmd.Wait()
-}
-
-func sendToSyslog(prio syslog.Priority, msg string) {
-
-	switch prio {
-	case syslog.LOG_DEBUG:
-		slog.Debug(msg)
-	case syslog.LOG_INFO:
-		slog.Info(msg)
-	case syslog.LOG_NOTICE:
-		slog.Notice(msg)
-	case syslog.LOG_WARNING:
-		slog.Warning(msg)
-	case syslog.LOG_ERR:
-		slog.Err(msg)
-	case syslog.LOG_ALERT:
-		slog.Alert(msg)
-	case syslog.LOG_EMERG:
-		slog.Emerg(msg)
-	case syslog.LOG_CRIT:
-		slog.Crit(msg)
+	if withTrace {
+		var stack = make([]byte, stackMax)
+		stack = stack[:runtime.Stack(stack, true)]
+		fmt.Fprintf(&body, "\n\n%s\n", stack)
 	}
-}
 
-var prioName = map[string]syslog.Priority{
-	"kern":     syslog.LOG_KERN,
-	"user":     syslog.LOG_USER,
-	"mail":     syslog.LOG_MAIL,
-	"daemon":   syslog.LOG_DAEMON,
-	"auth":     syslog.LOG_AUTH,
-	"syslog":   syslog.LOG_SYSLOG,
-	"lpr":      syslog.LOG_LPR,
-	"news":     syslog.LOG_NEWS,
-	"uucp":     syslog.LOG_UUCP,
-	"cron":     syslog.LOG_CRON,
-	"authpriv": syslog.LOG_AUTHPRIV,
-	"ftp":      syslog.LOG_FTP,
-	"local0":   syslog.LOG_LOCAL0,
-	"local1":   syslog.LOG_LOCAL1,
-	"local2":   syslog.LOG_LOCAL2,
-	"local3":   syslog.LOG_LOCAL3,
-	"local4":   syslog.LOG_LOCAL4,
-	"local5":   syslog.LOG_LOCAL5,
-	"local6":   syslog.LOG_LOCAL6,
-	"local7":   syslog.LOG_LOCAL7,
-}
-
-func openSyslog(fac string) {
-
-	p, ok := prioName[strings.ToLower(fac)]
+	job := mailJob{
+		mailer:  resolveMailer(cf, &dcf),
+		from:    dcf.mailFrom,
+		to:      []string{dcf.mailTo},
+		subject: fmt.Sprintf("%s daemon error", dcf.progname),
+		body:    body.String(),
+	}
 
-	if !ok {
+	if syncSend {
+		if err := sendMailNow(job); err != nil {
+			fmt.Fprintf(os.Stderr, "diag: mail send: %s\n", err)
+		}
 		return
 	}
 
-	slog, _ = syslog.New(p, progname)
+	queueMail(job)
 }
 
 // trim full pathname to dir/file.go
@@ -429,22 +479,18 @@ func cleanFunName(n string) string {
 	return n
 }
 
-func (cf *Config) rateLimited(addr string) bool {
-	lock.Lock()
-	defer lock.Unlock()
-
-	now := time.Now()
-	sent := mailSent[addr]
-
-	limit := cf.MailRateLimit
-	if limit == 0 {
-		limit = rateLimit
+// formatFields renders a Diag's structured fields (see With, NewContext)
+// as " key=val key2=val2", sorted for deterministic output.
+func formatFields(fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 
-	if now.After(sent.Add(limit)) {
-		mailSent[addr] = now
-		return false
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
 	}
-
-	return true
+	return b.String()
 }
@@ -0,0 +1,159 @@
+// Copyright (c) 2024
+// Author: Jeff Weisberg <jaw @ tcp4me.com>
+// Created: 2024-Apr-11 09:40 (EDT)
+// Function: log levels + per-section overrides
+
+package diag
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Level is a log verbosity level, from most to least verbose.
+type Level int
+
+const (
+	_ Level = iota // zero value is "unset", falls back to the default threshold
+	LevelTrace
+	LevelDebug
+	LevelVerbose
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+var levelName = map[string]Level{
+	"TRACE":   LevelTrace,
+	"DEBUG":   LevelDebug,
+	"VERBOSE": LevelVerbose,
+	"INFO":    LevelInfo,
+	"WARN":    LevelWarn,
+	"ERROR":   LevelError,
+	"FATAL":   LevelFatal,
+}
+
+// String returns the canonical name of the level, eg "DEBUG".
+func (l Level) String() string {
+	for name, v := range levelName {
+		if v == l {
+			return name
+		}
+	}
+	return "?"
+}
+
+// ParseLevel parses a level name ("trace", "DEBUG", ...) into a Level.
+func ParseLevel(s string) (Level, error) {
+	l, ok := levelName[strings.ToUpper(strings.TrimSpace(s))]
+	if !ok {
+		return 0, fmt.Errorf("diag: unknown level %q", s)
+	}
+	return l, nil
+}
+
+// ParseLevelOverrides parses a comma-separated list of "section=LEVEL"
+// pairs, eg "net=DEBUG,auth=TRACE", as read from an env var or CLI flag.
+func ParseLevelOverrides(s string) (map[string]Level, error) {
+	out := make(map[string]Level)
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("diag: invalid level override %q", part)
+		}
+
+		lvl, err := ParseLevel(kv[1])
+		if err != nil {
+			return nil, err
+		}
+
+		out[strings.TrimSpace(kv[0])] = lvl
+	}
+
+	return out, nil
+}
+
+// enabled reports whether messages at the given level should be emitted
+// for this logger's section. Config.LevelOverrides is consulted first;
+// only when the section (or "all") has no override do we fall back to
+// Config.LogLevel and the legacy debugAll/Config.Debug settings.
+func (d *Diag) enabled(level Level) bool {
+	cf := getConfig()
+
+	if cf != nil {
+		if ov, ok := cf.LevelOverrides[d.section]; ok {
+			return level >= ov
+		}
+		if ov, ok := cf.LevelOverrides["all"]; ok {
+			return level >= ov
+		}
+	}
+
+	threshold := LevelVerbose
+	if cf != nil && cf.LogLevel != 0 {
+		threshold = cf.LogLevel
+	}
+
+	if d.debugAll || (cf != nil && (cf.Debug[d.section] || cf.Debug["all"])) {
+		if threshold > LevelDebug {
+			threshold = LevelDebug
+		}
+	}
+
+	return level >= threshold
+}
+
+// flagLevelOverrides holds the LevelOverrides set via -loglevels or
+// DIAG_LOG_LEVELS, kept separate from Config.LevelOverrides so that a
+// later SetConfig call - which replaces config wholesale - can merge
+// them back in instead of silently discarding them.
+var flagLevelOverrides map[string]Level
+
+// levelOverrideFlag lets -loglevels be specified repeatedly or once with
+// a comma-separated list; each Set() call merges into the live config.
+type levelOverrideFlag struct{}
+
+func (levelOverrideFlag) String() string { return "" }
+
+func (levelOverrideFlag) Set(s string) error {
+	ov, err := ParseLevelOverrides(s)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if flagLevelOverrides == nil {
+		flagLevelOverrides = make(map[string]Level, len(ov))
+	}
+	if config.LevelOverrides == nil {
+		config.LevelOverrides = make(map[string]Level, len(ov))
+	}
+	for k, v := range ov {
+		flagLevelOverrides[k] = v
+		config.LevelOverrides[k] = v
+	}
+
+	return nil
+}
+
+func init() {
+	flag.Var(levelOverrideFlag{}, "loglevels", "comma separated list of section=LEVEL overrides")
+
+	if s := os.Getenv("DIAG_LOG_LEVELS"); s != "" {
+		if ov, err := ParseLevelOverrides(s); err == nil {
+			flagLevelOverrides = ov
+			config.LevelOverrides = ov
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2026
+// Author: Jeff Weisberg <jaw @ tcp4me.com>
+// Created: 2026-Jul-27 (EDT)
+// Function: test
+
+package diag
+
+import "testing"
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Level
+	}{
+		{"trace", LevelTrace},
+		{"DEBUG", LevelDebug},
+		{" Verbose ", LevelVerbose},
+		{"info", LevelInfo},
+		{"warn", LevelWarn},
+		{"error", LevelError},
+		{"fatal", LevelFatal},
+	}
+
+	for _, c := range cases {
+		got, err := ParseLevel(c.in)
+		if err != nil {
+			t.Errorf("ParseLevel(%q): unexpected error: %s", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ParseLevel(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+
+	if _, err := ParseLevel("bogus"); err == nil {
+		t.Error("ParseLevel(bogus): expected error, got nil")
+	}
+}
+
+func TestParseLevelOverrides(t *testing.T) {
+	ov, err := ParseLevelOverrides("net=DEBUG, auth = TRACE,all=INFO")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := map[string]Level{"net": LevelDebug, "auth": LevelTrace, "all": LevelInfo}
+	if len(ov) != len(want) {
+		t.Fatalf("got %d entries, want %d: %v", len(ov), len(want), ov)
+	}
+	for k, v := range want {
+		if ov[k] != v {
+			t.Errorf("ov[%q] = %v, want %v", k, ov[k], v)
+		}
+	}
+
+	if _, err := ParseLevelOverrides("net"); err == nil {
+		t.Error("expected error for entry missing '='")
+	}
+	if _, err := ParseLevelOverrides("net=bogus"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+
+	empty, err := ParseLevelOverrides("")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(empty) != 0 {
+		t.Errorf("got %d entries for empty input, want 0", len(empty))
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	defer SetConfig(Config{})
+
+	d := &Diag{section: "net"}
+
+	SetConfig(Config{})
+	if d.enabled(LevelVerbose) != true {
+		t.Error("default threshold should allow LevelVerbose")
+	}
+	if d.enabled(LevelDebug) != false {
+		t.Error("default threshold should suppress LevelDebug")
+	}
+
+	SetConfig(Config{LogLevel: LevelWarn})
+	if d.enabled(LevelInfo) != false {
+		t.Error("LogLevel=Warn should suppress LevelInfo")
+	}
+	if d.enabled(LevelWarn) != true {
+		t.Error("LogLevel=Warn should allow LevelWarn")
+	}
+
+	SetConfig(Config{LogLevel: LevelWarn, Debug: map[string]bool{"net": true}})
+	if d.enabled(LevelDebug) != true {
+		t.Error("Debug[section]=true should lower the threshold to LevelDebug even under a higher LogLevel")
+	}
+
+	SetConfig(Config{LevelOverrides: map[string]Level{"net": LevelError}})
+	if d.enabled(LevelWarn) != false {
+		t.Error("LevelOverrides[section] should take precedence and suppress LevelWarn")
+	}
+	if d.enabled(LevelError) != true {
+		t.Error("LevelOverrides[section] should allow LevelError")
+	}
+
+	SetConfig(Config{LevelOverrides: map[string]Level{"all": LevelDebug}})
+	if d.enabled(LevelDebug) != true {
+		t.Error("LevelOverrides[all] should apply to a section with no override of its own")
+	}
+}
+
+func TestSetConfigPreservesFlagLevelOverrides(t *testing.T) {
+	defer func() {
+		flagLevelOverrides = nil
+		SetConfig(Config{})
+	}()
+
+	// simulate -loglevels/DIAG_LOG_LEVELS having set a flag override
+	// before the application's own SetConfig call.
+	flagLevelOverrides = map[string]Level{"net": LevelDebug}
+
+	SetConfig(Config{LogLevel: LevelWarn})
+
+	d := &Diag{section: "net"}
+	if !d.enabled(LevelDebug) {
+		t.Error("SetConfig discarded a LevelOverride set via -loglevels/DIAG_LOG_LEVELS")
+	}
+}
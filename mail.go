@@ -0,0 +1,219 @@
+// Copyright (c) 2024
+// Author: Jeff Weisberg <jaw @ tcp4me.com>
+// Created: 2024-Aug-07 16:50 (EDT)
+// Function: pluggable mail transport
+
+package diag
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer delivers a single email, eg for Problem/Bug/Fatal notifications.
+type Mailer interface {
+	Send(ctx context.Context, from string, to []string, subject, body string) error
+}
+
+// SendmailMailer shells out to a local sendmail-compatible binary. It is
+// the default Mailer when neither Config.Mailer nor Config.SMTP is set.
+type SendmailMailer struct {
+	// Path defaults to "sendmail"
+	Path string
+}
+
+func (m SendmailMailer) Send(ctx context.Context, from string, to []string, subject, body string) error {
+	path := m.Path
+	if path == "" {
+		path = "sendmail"
+	}
+
+	cmd := exec.CommandContext(ctx, path, "-t", "-f", from)
+
+	p, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(p, "To: %s\nFrom: %s\nSubject: %s\n\n%s",
+		strings.Join(to, ", "), from, subject, body)
+	p.Close()
+
+	return cmd.Wait()
+}
+
+// SMTPConfig configures the Mailer returned by NewSMTPMailer.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	STARTTLS bool
+}
+
+type smtpMailer struct {
+	cf SMTPConfig
+}
+
+// NewSMTPMailer returns a Mailer that delivers mail directly via SMTP.
+func NewSMTPMailer(cf SMTPConfig) Mailer {
+	return &smtpMailer{cf: cf}
+}
+
+func (m *smtpMailer) Send(ctx context.Context, from string, to []string, subject, body string) error {
+	addr := fmt.Sprintf("%s:%d", m.cf.Host, m.cf.Port)
+	msg := fmt.Sprintf("To: %s\nFrom: %s\nSubject: %s\n\n%s",
+		strings.Join(to, ", "), from, subject, body)
+
+	// net/smtp has no native context support, so the dial (the only part
+	// that can hang indefinitely on an unreachable/slow host) goes
+	// through a context-aware Dialer, and the whole transaction races
+	// ctx.Done() so a caller-imposed deadline (eg sendMailNow's
+	// mailTimeout) is still honored even once the dial succeeds.
+	done := make(chan error, 1)
+	go func() {
+		done <- m.send(ctx, addr, from, to, msg)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *smtpMailer) send(ctx context.Context, addr, from string, to []string, msg string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, m.cf.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.cf.STARTTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: m.cf.Host}); err != nil {
+			return err
+		}
+	}
+	if m.cf.User != "" {
+		auth := smtp.PlainAuth("", m.cf.User, m.cf.Password, m.cf.Host)
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// resolveMailer picks the Mailer for a notification: a per-Diag override,
+// else Config.Mailer, else SMTP if configured, else SendmailMailer.
+func resolveMailer(cf *Config, d *Diag) Mailer {
+	if d.mailer != nil {
+		return d.mailer
+	}
+	if cf.Mailer != nil {
+		return cf.Mailer
+	}
+	if cf.SMTP.Host != "" {
+		return NewSMTPMailer(cf.SMTP)
+	}
+
+	return SendmailMailer{Path: cf.Sendmail}
+}
+
+// ################################################################
+// outbound Problem()/Bug() mail is queued through a small worker pool,
+// rather than one goroutine per message, so a burst of calls runs at most
+// mailWorkers sends at a time and can't leak cmd.Wait goroutines; a job
+// that finds the queue full is dropped. Fatal() mail bypasses the queue
+// (see sendMailNow).
+
+type mailJob struct {
+	mailer  Mailer
+	from    string
+	to      []string
+	subject string
+	body    string
+}
+
+const (
+	mailQueueSize = 64
+	mailWorkers   = 2
+	mailTimeout   = 60 * time.Second
+)
+
+var mailQueue = make(chan mailJob, mailQueueSize)
+var mailWorkersOnce sync.Once
+
+func queueMail(job mailJob) {
+	mailWorkersOnce.Do(startMailWorkers)
+
+	select {
+	case mailQueue <- job:
+	default:
+		fmt.Fprintf(os.Stderr, "diag: mail queue full, dropping message to %v\n", job.to)
+	}
+}
+
+// sendMailNow delivers job synchronously, for callers (eg Fatal) that
+// can't risk it still sitting in mailQueue when the process exits.
+func sendMailNow(job mailJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+	defer cancel()
+
+	return job.mailer.Send(ctx, job.from, job.to, job.subject, job.body)
+}
+
+func startMailWorkers() {
+	for i := 0; i < mailWorkers; i++ {
+		go mailWorker()
+	}
+}
+
+func mailWorker() {
+	for job := range mailQueue {
+		if err := sendMailNow(job); err != nil {
+			fmt.Fprintf(os.Stderr, "diag: mail send: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2024
+// Author: Jeff Weisberg <jaw @ tcp4me.com>
+// Created: 2024-Sep-22 11:03 (EDT)
+// Function: token-bucket + digest rate limiting for problem/bug mail
+
+package diag
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMailRateLimit  = time.Minute
+	defaultMailBurst      = 1
+	defaultDigestInterval = 15 * time.Minute
+)
+
+type rlKey struct {
+	section string
+	addr    string
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type digestEntry struct {
+	count  int
+	first  time.Time
+	last   time.Time
+	sample string
+}
+
+var rlLock sync.Mutex
+var buckets = map[rlKey]*tokenBucket{}
+var digests = map[rlKey]map[string]*digestEntry{}
+var digestTickerOnce sync.Once
+
+// allowMail reports whether a mail to addr for this section may be sent
+// now, consuming a token from its bucket if so.
+func (cf *Config) allowMail(section, addr string) bool {
+	rlLock.Lock()
+	defer rlLock.Unlock()
+
+	refill := cf.MailRateLimit
+	if refill <= 0 {
+		refill = defaultMailRateLimit
+	}
+	burst := cf.MailBurst
+	if burst <= 0 {
+		burst = defaultMailBurst
+	}
+
+	key := rlKey{section, addr}
+	now := time.Now()
+
+	b := buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: float64(burst), updated: now}
+		buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.updated).Seconds() / refill.Seconds()
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.updated = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// recordSuppressed buffers a message that didn't get its own mail
+// because the token bucket was empty, keyed by dedupeKey (the caller's
+// file:line), for later summarizing by flushDigests.
+func recordSuppressed(section, addr, dedupeKey, text string) {
+	digestTickerOnce.Do(startDigestTicker)
+
+	rlLock.Lock()
+	defer rlLock.Unlock()
+
+	m := digests[rlKey{section, addr}]
+	if m == nil {
+		m = map[string]*digestEntry{}
+		digests[rlKey{section, addr}] = m
+	}
+
+	now := time.Now()
+	e := m[dedupeKey]
+	if e == nil {
+		e = &digestEntry{first: now, sample: text}
+		m[dedupeKey] = e
+	}
+	e.count++
+	e.last = now
+}
+
+// flushDigests sends one summary email per (section,address) covering
+// all messages suppressed since the last flush. It sends synchronously
+// (rather than through the async mailQueue) so that Flush and
+// InstallShutdown's signal handler can be sure delivery has actually
+// completed before they return or exit.
+func flushDigests() {
+	rlLock.Lock()
+	pending := digests
+	digests = map[rlKey]map[string]*digestEntry{}
+	rlLock.Unlock()
+
+	cf := getConfig()
+	if cf == nil {
+		return
+	}
+
+	for key, entries := range pending {
+		if len(entries) == 0 {
+			continue
+		}
+
+		var body strings.Builder
+		fmt.Fprintf(&body, "digest of suppressed messages for section %q\n\n", key.section)
+		for dedupeKey, e := range entries {
+			fmt.Fprintf(&body, "%d occurrences of %s at %s — first/last seen at %s / %s\n",
+				e.count, e.sample, dedupeKey, e.first.Format(time.RFC3339), e.last.Format(time.RFC3339))
+		}
+
+		prog := cf.ProgName
+		if prog == "" {
+			prog = progname
+		}
+
+		job := mailJob{
+			mailer:  resolveMailer(cf, &Diag{section: key.section}),
+			from:    cf.MailFrom,
+			to:      []string{key.addr},
+			subject: fmt.Sprintf("%s daemon error digest", prog),
+			body:    body.String(),
+		}
+
+		if err := sendMailNow(job); err != nil {
+			fmt.Fprintf(os.Stderr, "diag: mail send: %s\n", err)
+		}
+	}
+}
+
+func startDigestTicker() {
+	go func() {
+		for {
+			interval := defaultDigestInterval
+			if cf := getConfig(); cf != nil && cf.DigestInterval > 0 {
+				interval = cf.DigestInterval
+			}
+			time.Sleep(interval)
+			flushDigests()
+		}
+	}()
+}
+
+// Flush forces any buffered digest messages to be sent immediately,
+// rather than waiting for Config.DigestInterval.
+func (d *Diag) Flush() {
+	flushDigests()
+}
+
+// Flush forces any buffered digest messages to be sent immediately
+func Flush() {
+	defaultDiag.Flush()
+}
+
+// InstallShutdown installs a SIGTERM/SIGINT handler that flushes any
+// buffered digest mail before the process exits, so a daemon doesn't
+// lose the last batch of suppressed messages on exit.
+func InstallShutdown() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		<-ch
+		flushDigests()
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2026
+// Author: Jeff Weisberg <jaw @ tcp4me.com>
+// Created: 2026-Jul-27 (EDT)
+// Function: test
+
+package diag
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowMailBurst(t *testing.T) {
+	cf := &Config{MailRateLimit: time.Hour, MailBurst: 2}
+
+	if !cf.allowMail("burst-test", "a@example.com") {
+		t.Error("first call should consume the first burst token")
+	}
+	if !cf.allowMail("burst-test", "a@example.com") {
+		t.Error("second call should consume the second burst token")
+	}
+	if cf.allowMail("burst-test", "a@example.com") {
+		t.Error("third call should be denied once the burst is exhausted")
+	}
+}
+
+func TestAllowMailRefill(t *testing.T) {
+	cf := &Config{MailRateLimit: 10 * time.Millisecond, MailBurst: 1}
+
+	if !cf.allowMail("refill-test", "a@example.com") {
+		t.Fatal("first call should consume the only token")
+	}
+	if cf.allowMail("refill-test", "a@example.com") {
+		t.Fatal("immediate second call should be denied")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if !cf.allowMail("refill-test", "a@example.com") {
+		t.Error("call after the refill period should be allowed again")
+	}
+}
+
+func TestAllowMailPerKey(t *testing.T) {
+	cf := &Config{MailRateLimit: time.Hour, MailBurst: 1}
+
+	if !cf.allowMail("key-a", "a@example.com") {
+		t.Error("section key-a should have its own bucket")
+	}
+	if !cf.allowMail("key-b", "a@example.com") {
+		t.Error("a different section should have an independent bucket")
+	}
+	if !cf.allowMail("key-a", "b@example.com") {
+		t.Error("a different address should have an independent bucket")
+	}
+}
+
+func TestRecordSuppressedDedupe(t *testing.T) {
+	rlLock.Lock()
+	digests = map[rlKey]map[string]*digestEntry{}
+	rlLock.Unlock()
+
+	recordSuppressed("dedupe-test", "a@example.com", "foo.go:10", "first")
+	recordSuppressed("dedupe-test", "a@example.com", "foo.go:10", "second")
+	recordSuppressed("dedupe-test", "a@example.com", "bar.go:20", "third")
+
+	rlLock.Lock()
+	m := digests[rlKey{"dedupe-test", "a@example.com"}]
+	rlLock.Unlock()
+
+	if len(m) != 2 {
+		t.Fatalf("got %d distinct dedupe keys, want 2", len(m))
+	}
+	if m["foo.go:10"].count != 2 {
+		t.Errorf("foo.go:10 count = %d, want 2", m["foo.go:10"].count)
+	}
+	if m["bar.go:20"].count != 1 {
+		t.Errorf("bar.go:20 count = %d, want 1", m["bar.go:20"].count)
+	}
+	if m["foo.go:10"].sample != "first" {
+		t.Errorf("sample should be the first occurrence's text, got %q", m["foo.go:10"].sample)
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2024
+// Author: Jeff Weisberg <jaw @ tcp4me.com>
+// Created: 2024-Mar-02 10:14 (EST)
+// Function: pluggable log sinks
+
+package diag
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Entry is a single log event, passed to every configured Sink.
+type Entry struct {
+	Section string
+	Level   Level
+	Time    time.Time
+	File    string
+	Line    int
+	Func    string
+	Text    string
+	Fields  map[string]interface{}
+}
+
+// Sink is a destination that log entries can be fanned out to, in
+// addition to the built-in stderr/syslog/email paths.
+type Sink interface {
+	WriteMsg(entry Entry) error
+	Close()
+}
+
+var sinkRegistryLock sync.Mutex
+var sinkRegistry = map[string]Sink{}
+
+// sinkErrCooldown bounds how often a given Sink's WriteMsg errors are
+// reported to stderr - eg a syslog daemon that's down would otherwise
+// print one line per log call for as long as it stays down.
+const sinkErrCooldown = time.Minute
+
+var sinkErrLock sync.Mutex
+var sinkErrLast = map[Sink]time.Time{}
+var sinkErrSuppressed = map[Sink]int{}
+
+// reportSinkErr prints a WriteMsg failure to stderr, rate-limited per
+// sink so a sink that's continuously failing doesn't spam one line per
+// log call; suppressed occurrences are rolled into the next line.
+func reportSinkErr(s Sink, err error) {
+	sinkErrLock.Lock()
+	defer sinkErrLock.Unlock()
+
+	if last, ok := sinkErrLast[s]; ok && time.Since(last) < sinkErrCooldown {
+		sinkErrSuppressed[s]++
+		return
+	}
+
+	suppressed := sinkErrSuppressed[s]
+	sinkErrSuppressed[s] = 0
+	sinkErrLast[s] = time.Now()
+
+	if suppressed > 0 {
+		fmt.Fprintf(os.Stderr, "diag: sink %T: %s (%d more suppressed)\n", s, err, suppressed)
+	} else {
+		fmt.Fprintf(os.Stderr, "diag: sink %T: %s\n", s, err)
+	}
+}
+
+// RegisterSink registers a named Sink that receives every log entry,
+// regardless of the active Config. It is meant for sinks that should
+// always be active, e.g. wired up by an init() in some other package.
+func RegisterSink(name string, s Sink) {
+	sinkRegistryLock.Lock()
+	defer sinkRegistryLock.Unlock()
+
+	sinkRegistry[name] = s
+}
+
+// activeSinks returns the registered sinks, the syslog sink (if
+// configured), and any sinks configured on Config.
+func activeSinks() []Sink {
+	sinkRegistryLock.Lock()
+	snks := make([]Sink, 0, len(sinkRegistry)+1)
+	for _, s := range sinkRegistry {
+		snks = append(snks, s)
+	}
+	sinkRegistryLock.Unlock()
+
+	lock.RLock()
+	ss := sysSink
+	cf := config
+	lock.RUnlock()
+
+	if ss != nil {
+		snks = append(snks, ss)
+	}
+	if cf != nil {
+		snks = append(snks, cf.Sinks...)
+	}
+
+	return snks
+}
+
+// formatEntry renders an Entry as a single text line, for sinks that
+// don't have a more structured format of their own.
+func formatEntry(e Entry) string {
+	return fmt.Sprintf("%s %s %s:%d %s(): %s\n",
+		e.Time.Format(time.RFC3339), e.Section, e.File, e.Line, e.Func, e.Text)
+}
+
+// ################################################################
+
+type fileSink struct {
+	lock       sync.Mutex
+	path       string
+	rotateSize int64
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink returns a Sink that appends formatted entries to path,
+// rotating the file to path+".1" once it grows past rotateSize bytes.
+// rotateSize <= 0 disables rotation.
+func NewFileSink(path string, rotateSize int64) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &fileSink{path: path, rotateSize: rotateSize, file: f, size: fi.Size()}, nil
+}
+
+func (s *fileSink) WriteMsg(e Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	line := formatEntry(e)
+	n, err := s.file.WriteString(line)
+	if err != nil {
+		return err
+	}
+
+	s.size += int64(n)
+	if s.rotateSize > 0 && s.size >= s.rotateSize {
+		s.rotate()
+	}
+
+	return nil
+}
+
+func (s *fileSink) rotate() {
+	s.file.Close()
+	os.Rename(s.path, s.path+".1")
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		// best effort: keep going without a file, next WriteMsg will error
+		s.file = nil
+		return
+	}
+
+	s.file = f
+	s.size = 0
+}
+
+func (s *fileSink) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.file != nil {
+		s.file.Close()
+	}
+}
+
+// ################################################################
+
+type connSink struct {
+	lock           sync.Mutex
+	network        string
+	addr           string
+	reconnectOnMsg bool
+	conn           net.Conn
+}
+
+// NewConnSink returns a Sink that writes formatted entries to a network
+// connection (eg "tcp", "udp", "unixgram"). If reconnectOnMsg is set, a
+// fresh connection is dialed for every message, otherwise the connection
+// is dialed lazily and reused until a write fails.
+func NewConnSink(network, addr string, reconnectOnMsg bool) Sink {
+	return &connSink{network: network, addr: addr, reconnectOnMsg: reconnectOnMsg}
+}
+
+func (s *connSink) WriteMsg(e Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil || s.reconnectOnMsg {
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+
+		c, err := net.Dial(s.network, s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = c
+	}
+
+	_, err := s.conn.Write([]byte(formatEntry(e)))
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return err
+}
+
+func (s *connSink) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// ################################################################
+
+type jsonSink struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewJSONSink returns a Sink that writes each Entry as a line of JSON,
+// for consumption by log aggregators.
+func NewJSONSink(w io.Writer) Sink {
+	return &jsonSink{w: w}
+}
+
+func (s *jsonSink) WriteMsg(e Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+	_, err = s.w.Write(b)
+	return err
+}
+
+func (s *jsonSink) Close() {}
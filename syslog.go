@@ -0,0 +1,137 @@
+// Copyright (c) 2024
+// Author: Jeff Weisberg <jaw @ tcp4me.com>
+// Created: 2024-Jun-18 21:05 (EDT)
+// Function: resilient syslog sink
+
+package diag
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+var prioName = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// sysSink is the Sink feeding the local/remote syslog daemon, rebuilt
+// whenever SetConfig is called with a Facility. It is guarded by the
+// package-level `lock`, same as `config`.
+var sysSink *syslogSink
+
+// configureSyslog (re)builds sysSink from cf, closing any previous one.
+// Called with `lock` already held, from SetConfig.
+func configureSyslog(cf Config) {
+	old := sysSink
+	sysSink = nil
+
+	if cf.Facility != "" {
+		if fac, ok := prioName[strings.ToLower(cf.Facility)]; ok {
+			sysSink = newSyslogSink(cf.SyslogNetwork, cf.SyslogAddr, fac, progname)
+		}
+	}
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+// syslogSink dials the syslog daemon lazily, on the first message, and
+// redials once on a write failure before giving up - so a daemon that
+// isn't up yet, or that restarts, doesn't permanently blackhole logs.
+type syslogSink struct {
+	lock     sync.Mutex
+	network  string
+	raddr    string
+	facility syslog.Priority
+	tag      string
+	conn     *syslog.Writer
+}
+
+func newSyslogSink(network, raddr string, facility syslog.Priority, tag string) *syslogSink {
+	return &syslogSink{network: network, raddr: raddr, facility: facility, tag: tag}
+}
+
+func (s *syslogSink) dial() (*syslog.Writer, error) {
+	if s.network == "" {
+		return syslog.New(s.facility, s.tag)
+	}
+	return syslog.Dial(s.network, s.raddr, s.facility, s.tag)
+}
+
+func (s *syslogSink) WriteMsg(e Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	if err := s.write(e); err != nil {
+		s.conn.Close()
+		s.conn = nil
+
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+
+		return s.write(e)
+	}
+
+	return nil
+}
+
+func (s *syslogSink) write(e Entry) error {
+	msg := e.Text
+	if e.File != "" {
+		msg = fmt.Sprintf("%s:%d %s(): %s", e.File, e.Line, e.Func, e.Text)
+	}
+
+	switch {
+	case e.Level <= LevelDebug:
+		return s.conn.Debug(msg)
+	case e.Level <= LevelInfo:
+		return s.conn.Info(msg)
+	case e.Level == LevelWarn:
+		return s.conn.Warning(msg)
+	default:
+		return s.conn.Err(msg)
+	}
+}
+
+func (s *syslogSink) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}